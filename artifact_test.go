@@ -0,0 +1,187 @@
+package saml
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func makeArtifact(t *testing.T, typeCode uint16, endpointIndex uint16, sourceID, messageHandle [20]byte) string {
+	t.Helper()
+
+	raw := make([]byte, samlArtifactLength)
+	raw[0] = byte(typeCode >> 8)
+	raw[1] = byte(typeCode)
+	raw[2] = byte(endpointIndex >> 8)
+	raw[3] = byte(endpointIndex)
+	copy(raw[4:24], sourceID[:])
+	copy(raw[24:44], messageHandle[:])
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestParseArtifact(t *testing.T) {
+	sourceID := sha1.Sum([]byte("https://idp.example.org/metadata"))
+	var messageHandle [20]byte
+	copy(messageHandle[:], []byte("0123456789abcdefghi"))
+
+	encoded := makeArtifact(t, SAMLArtifactTypeCode0004, 7, sourceID, messageHandle)
+
+	art, err := ParseArtifact(encoded)
+	assert.NilError(t, err)
+	assert.Equal(t, art.TypeCode, uint16(SAMLArtifactTypeCode0004))
+	assert.Equal(t, art.EndpointIndex, uint16(7))
+	assert.Equal(t, art.SourceID, sourceID)
+	assert.Equal(t, art.MessageHandle, messageHandle)
+}
+
+func TestParseArtifactInvalidEncoding(t *testing.T) {
+	_, err := ParseArtifact("not valid base64!!")
+	assert.ErrorContains(t, err, "encoding")
+}
+
+func TestParseArtifactWrongLength(t *testing.T) {
+	_, err := ParseArtifact(base64.StdEncoding.EncodeToString([]byte("too short")))
+	assert.ErrorContains(t, err, "unexpected length")
+}
+
+func TestParseArtifactUnsupportedTypeCode(t *testing.T) {
+	var sourceID, messageHandle [20]byte
+	encoded := makeArtifact(t, 0x0001, 0, sourceID, messageHandle)
+
+	_, err := ParseArtifact(encoded)
+	assert.ErrorContains(t, err, "unsupported SAMLart type code")
+}
+
+func TestParseArtifactFromRequest(t *testing.T) {
+	var sourceID, messageHandle [20]byte
+	encoded := makeArtifact(t, SAMLArtifactTypeCode0004, 0, sourceID, messageHandle)
+
+	r := httptest.NewRequest(http.MethodGet, "/?SAMLart="+url.QueryEscape(encoded), nil)
+	art, err := ParseArtifactFromRequest(r)
+	assert.NilError(t, err)
+	assert.Equal(t, art.TypeCode, uint16(SAMLArtifactTypeCode0004))
+}
+
+func TestParseArtifactFromRequestMissingParameter(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := ParseArtifactFromRequest(r)
+	assert.ErrorContains(t, err, "no SAMLart parameter")
+}
+
+func TestFindArtifactSourceIDP(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{
+				{EntityID: "https://idp-a.example.org/metadata"},
+				{EntityID: "https://idp-b.example.org/metadata"},
+			},
+		},
+	}
+
+	sourceID := sha1.Sum([]byte("https://idp-b.example.org/metadata"))
+	idp, err := smp.findArtifactSourceIDP(sourceID)
+	assert.NilError(t, err)
+	assert.Equal(t, idp.EntityID, "https://idp-b.example.org/metadata")
+}
+
+func TestFindArtifactSourceIDPNoMatch(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{{EntityID: "https://idp-a.example.org/metadata"}},
+		},
+	}
+
+	var sourceID [20]byte
+	_, err := smp.findArtifactSourceIDP(sourceID)
+	assert.ErrorContains(t, err, "no IDP matches")
+}
+
+func TestFindArtifactSourceIDPNoMetadata(t *testing.T) {
+	smp := &ServiceMultipleProvider{}
+	var sourceID [20]byte
+	_, err := smp.findArtifactSourceIDP(sourceID)
+	assert.ErrorContains(t, err, "no IDP metadata")
+}
+
+func TestArtifactResolutionServices(t *testing.T) {
+	assert.Assert(t, artifactResolutionServices(nil) == nil)
+
+	u, err := url.Parse("https://sp.example.org/saml/artifact")
+	assert.NilError(t, err)
+
+	endpoints := artifactResolutionServices(u)
+	assert.Equal(t, len(endpoints), 1)
+	assert.Equal(t, endpoints[0].Binding, SOAPBinding)
+	assert.Equal(t, endpoints[0].Location, u.String())
+}
+
+func TestResolveArtifactNoMatchingIDP(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{{EntityID: "https://idp.example.org/metadata"}},
+		},
+	}
+
+	var sourceID, messageHandle [20]byte
+	art := &SAMLArtifact{TypeCode: SAMLArtifactTypeCode0004, SourceID: sourceID, MessageHandle: messageHandle}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := smp.ResolveArtifact(r, art, nil)
+	assert.ErrorContains(t, err, "no IDP matches")
+}
+
+func TestValidateArtifactEndpointIndex(t *testing.T) {
+	idp := &EntityDescriptor{
+		EntityID: "https://idp.example.org/metadata",
+		IDPSSODescriptors: []IDPSSODescriptor{
+			{
+				SSODescriptor: SSODescriptor{
+					ArtifactResolutionServices: []IndexedEndpoint{
+						{Binding: SOAPBinding, Location: "https://idp.example.org/saml/artifact", Index: 3},
+					},
+				},
+			},
+		},
+	}
+
+	assert.NilError(t, validateArtifactEndpointIndex(idp, 3))
+
+	err := validateArtifactEndpointIndex(idp, 9)
+	assert.ErrorContains(t, err, "no ArtifactResolutionService at index 9")
+}
+
+func TestResolveArtifactRejectsUnknownEndpointIndex(t *testing.T) {
+	idpEntityID := "https://idp.example.org/metadata"
+	smp := &ServiceMultipleProvider{
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{
+				{
+					EntityID: idpEntityID,
+					IDPSSODescriptors: []IDPSSODescriptor{
+						{
+							SSODescriptor: SSODescriptor{
+								ArtifactResolutionServices: []IndexedEndpoint{
+									{Binding: SOAPBinding, Location: "https://idp.example.org/saml/artifact", Index: 0},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Providers: map[string]ServiceProvider{idpEntityID: {}},
+	}
+
+	sourceID := sha1.Sum([]byte(idpEntityID))
+	var messageHandle [20]byte
+	art := &SAMLArtifact{TypeCode: SAMLArtifactTypeCode0004, EndpointIndex: 7, SourceID: sourceID, MessageHandle: messageHandle}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := smp.ResolveArtifact(r, art, nil)
+	assert.ErrorContains(t, err, "no ArtifactResolutionService at index 7")
+}
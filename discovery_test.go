@@ -0,0 +1,139 @@
+package saml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDiscoveryReturnURLAllowed(t *testing.T) {
+	allowed := []string{"https://sp.example.org/saml/discovery-return"}
+
+	assert.Assert(t, discoveryReturnURLAllowed(allowed, "https://sp.example.org/saml/discovery-return"))
+	assert.Assert(t, !discoveryReturnURLAllowed(allowed, "https://evil.example.org/"))
+	assert.Assert(t, !discoveryReturnURLAllowed(nil, "https://sp.example.org/saml/discovery-return"))
+}
+
+func TestMakeDiscoveryRequest(t *testing.T) {
+	name := "https://discovery.example.org/ds"
+	smp := &ServiceMultipleProvider{
+		EntityID:    "https://sp.example.org/saml/metadata",
+		IDPMetadata: &EntitiesDescriptor{Name: &name},
+	}
+
+	u, err := smp.MakeDiscoveryRequest("https://sp.example.org/return", true)
+	assert.NilError(t, err)
+
+	q := u.Query()
+	assert.Equal(t, q.Get("entityID"), smp.EntityID)
+	assert.Equal(t, q.Get("return"), "https://sp.example.org/return")
+	assert.Equal(t, q.Get("returnIDParam"), DefaultReturnIDParam)
+	assert.Equal(t, q.Get("policy"), DefaultDiscoveryPolicy)
+	assert.Equal(t, q.Get("isPassive"), "true")
+}
+
+func TestMakeDiscoveryRequestMissingDiscoveryService(t *testing.T) {
+	smp := &ServiceMultipleProvider{}
+	_, err := smp.MakeDiscoveryRequest("https://sp.example.org/return", false)
+	assert.ErrorContains(t, err, "discovery service location")
+}
+
+func TestValidateDiscoveryResponse(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{{EntityID: "https://idp.example.org/metadata"}},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?entityID=https://idp.example.org/metadata", nil)
+	entityID, err := smp.ValidateDiscoveryResponse(r, "")
+	assert.NilError(t, err)
+	assert.Equal(t, entityID, "https://idp.example.org/metadata")
+
+	r = httptest.NewRequest(http.MethodGet, "/?entityID=https://unknown.example.org/metadata", nil)
+	_, err = smp.ValidateDiscoveryResponse(r, "")
+	assert.ErrorContains(t, err, "unknown entityID")
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = smp.ValidateDiscoveryResponse(r, "")
+	assert.ErrorContains(t, err, "missing entityID")
+}
+
+func TestServeDiscoveryRequestRejectsUnregisteredReturnURL(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		Providers: map[string]ServiceProvider{
+			"https://sp.example.org/metadata": {},
+		},
+		AllowedDiscoveryReturnURLs: map[string][]string{
+			"https://sp.example.org/metadata": {"https://sp.example.org/saml/discovery-return"},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?entityID=https://sp.example.org/metadata&return=https://evil.example.org/", nil)
+	w := httptest.NewRecorder()
+	smp.ServeDiscoveryRequest(w, r)
+
+	assert.Equal(t, w.Code, http.StatusForbidden)
+}
+
+func TestServeDiscoveryRequestRedirectsOnChoice(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		Providers: map[string]ServiceProvider{
+			"https://sp.example.org/metadata": {},
+		},
+		AllowedDiscoveryReturnURLs: map[string][]string{
+			"https://sp.example.org/metadata": {"https://sp.example.org/saml/discovery-return"},
+		},
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{{EntityID: "https://idp.example.org/metadata"}},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?entityID=https://sp.example.org/metadata&return=https://sp.example.org/saml/discovery-return&chosenEntityID=https://idp.example.org/metadata", nil)
+	w := httptest.NewRecorder()
+	smp.ServeDiscoveryRequest(w, r)
+
+	assert.Equal(t, w.Code, http.StatusFound)
+	loc, err := w.Result().Location()
+	assert.NilError(t, err)
+	assert.Equal(t, loc.Query().Get(DefaultReturnIDParam), "https://idp.example.org/metadata")
+}
+
+func TestServeDiscoveryRequestRejectsUnknownChosenEntityID(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		Providers: map[string]ServiceProvider{
+			"https://sp.example.org/metadata": {},
+		},
+		AllowedDiscoveryReturnURLs: map[string][]string{
+			"https://sp.example.org/metadata": {"https://sp.example.org/saml/discovery-return"},
+		},
+		IDPMetadata: &EntitiesDescriptor{
+			EntityDescriptors: []EntityDescriptor{{EntityID: "https://idp.example.org/metadata"}},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?entityID=https://sp.example.org/metadata&return=https://sp.example.org/saml/discovery-return&chosenEntityID=https://not-a-real-idp.example.org/metadata", nil)
+	w := httptest.NewRecorder()
+	smp.ServeDiscoveryRequest(w, r)
+
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+func TestServeDiscoveryRequestRejectsChosenEntityIDWithNoIDPMetadata(t *testing.T) {
+	smp := &ServiceMultipleProvider{
+		Providers: map[string]ServiceProvider{
+			"https://sp.example.org/metadata": {},
+		},
+		AllowedDiscoveryReturnURLs: map[string][]string{
+			"https://sp.example.org/metadata": {"https://sp.example.org/saml/discovery-return"},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?entityID=https://sp.example.org/metadata&return=https://sp.example.org/saml/discovery-return&chosenEntityID=https://idp.example.org/metadata", nil)
+	w := httptest.NewRecorder()
+	smp.ServeDiscoveryRequest(w, r)
+
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
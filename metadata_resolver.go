@@ -0,0 +1,49 @@
+package saml
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrMetadataNotFound is returned by a MetadataResolver when no metadata
+// is available for the requested entity, including when the resolver has
+// negatively cached a prior "not found" result.
+var ErrMetadataNotFound = errors.New("saml: metadata not found")
+
+// MetadataResolver resolves the metadata for a single IDP entity on
+// demand, as an alternative to loading a full EntitiesDescriptor
+// aggregate up front via FetchEntitiesMetadata into
+// ServiceMultipleProvider.IDPMetadata. This is useful against
+// large-scale federations (e.g. an OASIS MDQ endpoint) where fetching
+// every participant's metadata eagerly doesn't scale.
+type MetadataResolver interface {
+	// ResolveIDPMetadata returns the EntityDescriptor for entityID, or
+	// ErrMetadataNotFound if no such entity is known.
+	ResolveIDPMetadata(ctx context.Context, entityID string) (*EntityDescriptor, error)
+}
+
+// GetIDPMetadata returns the EntityDescriptor for the IDP identified by
+// entityID. If MetadataResolver is set, it is consulted first; otherwise,
+// or if it reports ErrMetadataNotFound, GetIDPMetadata falls back to a
+// linear search of the already-loaded IDPMetadata aggregate.
+func (smp *ServiceMultipleProvider) GetIDPMetadata(ctx context.Context, entityID string) (*EntityDescriptor, error) {
+	if smp.MetadataResolver != nil {
+		ed, err := smp.MetadataResolver.ResolveIDPMetadata(ctx, entityID)
+		if err == nil {
+			return ed, nil
+		}
+		if !errors.Is(err, ErrMetadataNotFound) {
+			return nil, err
+		}
+	}
+
+	if smp.IDPMetadata == nil {
+		return nil, ErrMetadataNotFound
+	}
+	for i, ed := range smp.IDPMetadata.EntityDescriptors {
+		if ed.EntityID == entityID {
+			return &smp.IDPMetadata.EntityDescriptors[i], nil
+		}
+	}
+	return nil, ErrMetadataNotFound
+}
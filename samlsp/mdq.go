@@ -0,0 +1,207 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insaplace/saml"
+)
+
+// mdqNegativeCacheTTL is how long a 404 response from the MDQ endpoint is
+// cached before MDQClient will try the entityID again.
+const mdqNegativeCacheTTL = 5 * time.Minute
+
+// mdqDefaultCacheTTL is used when the MDQ response carries no
+// Cache-Control max-age and the entity itself has no ValidUntil.
+const mdqDefaultCacheTTL = time.Hour
+
+// MDQClient implements saml.MetadataResolver against an OASIS Metadata
+// Query Protocol (MDQ, draft-young-md-query) endpoint, fetching and
+// caching one EntityDescriptor at a time instead of requiring a full
+// federation aggregate to be loaded up front via FetchEntitiesMetadata.
+type MDQClient struct {
+	// BaseURL is the MDQ endpoint, e.g. https://mdq.example.org/entities/
+	BaseURL url.URL
+
+	// HTTPClient is used to make MDQ requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	mu    sync.RWMutex
+	cache map[string]*mdqCacheEntry
+}
+
+type mdqCacheEntry struct {
+	entity       *saml.EntityDescriptor
+	etag         string
+	lastModified string
+	expiresAt    time.Time
+	notFound     bool
+}
+
+var _ saml.MetadataResolver = (*MDQClient)(nil)
+
+// ResolveIDPMetadata implements saml.MetadataResolver. It serves cached
+// metadata when it hasn't expired, and otherwise performs a conditional
+// GET against the MDQ endpoint, honoring ETag/Last-Modified/Cache-Control
+// and negatively caching 404 responses.
+func (c *MDQClient) ResolveIDPMetadata(ctx context.Context, entityID string) (*saml.EntityDescriptor, error) {
+	if entry := c.cached(entityID); entry != nil {
+		if entry.notFound {
+			return nil, saml.ErrMetadataNotFound
+		}
+		return entry.entity, nil
+	}
+
+	entry, err := c.fetch(ctx, entityID, c.cached(entityID))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.cache == nil {
+		c.cache = map[string]*mdqCacheEntry{}
+	}
+	c.cache[entityID] = entry
+	c.mu.Unlock()
+
+	if entry.notFound {
+		return nil, saml.ErrMetadataNotFound
+	}
+	return entry.entity, nil
+}
+
+// cached returns the cache entry for entityID if it is present and has
+// not yet expired.
+func (c *MDQClient) cached(entityID string) *mdqCacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.cache[entityID]
+	if !ok || saml.TimeNow().After(entry.expiresAt) {
+		return nil
+	}
+	return entry
+}
+
+// stale returns the previous cache entry for entityID regardless of
+// expiry, so that fetch can send conditional-request headers even when
+// the cached copy is no longer fresh enough to serve directly.
+func (c *MDQClient) stale(entityID string) *mdqCacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cache[entityID]
+}
+
+func (c *MDQClient) fetch(ctx context.Context, entityID string, fresh *mdqCacheEntry) (*mdqCacheEntry, error) {
+	if fresh != nil {
+		return fresh, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.entityURL(entityID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev := c.stale(entityID); prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if prev := c.stale(entityID); prev != nil {
+			updated := *prev
+			updated.expiresAt = c.expiryFor(resp, prev.entity)
+			return &updated, nil
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &mdqCacheEntry{notFound: true, expiresAt: saml.TimeNow().Add(mdqNegativeCacheTTL)}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mdq: unexpected status code %d for entityID %s", resp.StatusCode, entityID)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entity, err := ParseMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mdqCacheEntry{
+		entity:       entity,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		expiresAt:    c.expiryFor(resp, entity),
+	}, nil
+}
+
+// expiryFor derives a cache expiry from the MDQ response's Cache-Control
+// max-age, falling back to the entity's own ValidUntil, and finally to
+// mdqDefaultCacheTTL.
+func (c *MDQClient) expiryFor(resp *http.Response, entity *saml.EntityDescriptor) time.Time {
+	if maxAge, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+		return saml.TimeNow().Add(maxAge)
+	}
+	if entity != nil && !entity.ValidUntil.IsZero() {
+		return entity.ValidUntil
+	}
+	return saml.TimeNow().Add(mdqDefaultCacheTTL)
+}
+
+func parseMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// entityURL builds the MDQ request URL for entityID per the OASIS MDQ
+// spec: <base>/{sha1}<hex-of-sha1(entityID)>, with the identifier
+// segment percent-escaped.
+func (c *MDQClient) entityURL(entityID string) string {
+	sum := sha1.Sum([]byte(entityID))
+	identifier := "{sha1}" + hex.EncodeToString(sum[:])
+
+	// u.Path holds the unescaped path; u.String() percent-escapes it.
+	u := c.BaseURL
+	u.Path = path.Join(u.Path, identifier)
+	return u.String()
+}
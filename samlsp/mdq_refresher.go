@@ -0,0 +1,143 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"github.com/insaplace/saml"
+	"github.com/insaplace/saml/logger"
+)
+
+// mdqRefresherMinBackoff and mdqRefresherMaxBackoff bound the jittered
+// exponential backoff MetadataRefresher applies between retries of an
+// entityID that failed to resolve, so that an MDQ outage doesn't turn
+// into a hammering retry storm.
+const (
+	mdqRefresherMinBackoff = 30 * time.Second
+	mdqRefresherMaxBackoff = 15 * time.Minute
+)
+
+// MetadataRefresher periodically re-resolves a fixed set of entityIDs
+// through an MDQClient, ahead of their cache entry's expiry (derived from
+// Cache-Control max-age, else the EntityDescriptor's ValidUntil, else
+// mdqDefaultCacheTTL), so that subsequent ResolveIDPMetadata calls stay warm.
+// Failures are retried with jittered exponential backoff.
+type MetadataRefresher struct {
+	// Client is the MDQClient whose cache is kept warm.
+	Client *MDQClient
+
+	// EntityIDs are the entities to keep refreshed.
+	EntityIDs []string
+
+	// Interval is how often to check whether an entity needs refreshing.
+	// If zero, a default of one minute is used.
+	Interval time.Duration
+
+	// RefreshBefore is how far ahead of its cache expiry to refresh an entity.
+	// If zero, a default of 25% of the entity's remaining validity is
+	// used, with a minimum of five minutes.
+	RefreshBefore time.Duration
+}
+
+// Start runs the refresh loop until ctx is canceled.
+func (r *MetadataRefresher) Start(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	backoffUntil := make(map[string]time.Time, len(r.EntityIDs))
+	backoff := make(map[string]time.Duration, len(r.EntityIDs))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			for _, entityID := range r.EntityIDs {
+				if until, ok := backoffUntil[entityID]; ok && now.Before(until) {
+					continue
+				}
+				if !r.needsRefresh(entityID) {
+					continue
+				}
+
+				// Fetch unconditionally: ResolveIDPMetadata would serve the
+				// still-unexpired cached entry without contacting the server.
+				entry, err := r.Client.fetch(ctx, entityID, nil)
+				if err == nil {
+					r.Client.mu.Lock()
+					if r.Client.cache == nil {
+						r.Client.cache = map[string]*mdqCacheEntry{}
+					}
+					r.Client.cache[entityID] = entry
+					r.Client.mu.Unlock()
+					if entry.notFound {
+						err = saml.ErrMetadataNotFound
+					}
+				}
+				if err != nil {
+					next := nextBackoff(backoff[entityID])
+					backoff[entityID] = next
+					backoffUntil[entityID] = now.Add(jitter(next))
+					logger.DefaultLogger.Printf("mdq: failed to refresh metadata for %s, retrying within %s: %v", entityID, next, err)
+					continue
+				}
+
+				delete(backoff, entityID)
+				delete(backoffUntil, entityID)
+			}
+		}
+	}
+}
+
+// needsRefresh reports whether entityID's cached entry is missing or
+// within RefreshBefore of expiring.
+func (r *MetadataRefresher) needsRefresh(entityID string) bool {
+	entry := r.Client.stale(entityID)
+	if entry == nil {
+		return true
+	}
+
+	refreshBefore := r.RefreshBefore
+	if refreshBefore <= 0 {
+		if remaining := time.Until(entry.expiresAt); remaining > 0 {
+			refreshBefore = remaining / 4
+		}
+		if refreshBefore < 5*time.Minute {
+			refreshBefore = 5 * time.Minute
+		}
+	}
+
+	return time.Now().Add(refreshBefore).After(entry.expiresAt)
+}
+
+func nextBackoff(prev time.Duration) time.Duration {
+	if prev <= 0 {
+		return mdqRefresherMinBackoff
+	}
+	next := prev * 2
+	if next > mdqRefresherMaxBackoff {
+		next = mdqRefresherMaxBackoff
+	}
+	return next
+}
+
+// jitter returns a random duration in [0, d), implementing "full jitter"
+// so that replicas retrying the same entityID don't stay in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d)))
+	if err != nil {
+		return d
+	}
+	return time.Duration(n.Int64())
+}
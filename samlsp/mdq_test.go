@@ -0,0 +1,129 @@
+package samlsp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insaplace/saml"
+	"gotest.tools/assert"
+)
+
+func TestParseMaxAge(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		cacheControl string
+		wantOK       bool
+		wantDuration time.Duration
+	}{
+		{name: "simple", cacheControl: "max-age=3600", wantOK: true, wantDuration: time.Hour},
+		{name: "with other directives", cacheControl: "no-cache, max-age=60, must-revalidate", wantOK: true, wantDuration: time.Minute},
+		{name: "zero", cacheControl: "max-age=0", wantOK: true, wantDuration: 0},
+		{name: "missing", cacheControl: "no-cache", wantOK: false},
+		{name: "empty", cacheControl: "", wantOK: false},
+		{name: "negative", cacheControl: "max-age=-1", wantOK: false},
+		{name: "not a number", cacheControl: "max-age=soon", wantOK: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, ok := parseMaxAge(tc.cacheControl)
+			assert.Equal(t, ok, tc.wantOK)
+			if tc.wantOK {
+				assert.Equal(t, d, tc.wantDuration)
+			}
+		})
+	}
+}
+
+func TestMDQClientExpiryForUsesMaxAge(t *testing.T) {
+	c := &MDQClient{}
+	resp := &http.Response{Header: http.Header{"Cache-Control": []string{"max-age=120"}}}
+
+	before := saml.TimeNow()
+	got := c.expiryFor(resp, nil)
+	after := saml.TimeNow()
+
+	assert.Assert(t, !got.Before(before.Add(120*time.Second)))
+	assert.Assert(t, !got.After(after.Add(120*time.Second)))
+}
+
+func TestMDQClientExpiryForFallsBackToValidUntil(t *testing.T) {
+	c := &MDQClient{}
+	resp := &http.Response{Header: http.Header{}}
+	validUntil := saml.TimeNow().Add(10 * time.Minute)
+	entity := &saml.EntityDescriptor{ValidUntil: validUntil}
+
+	got := c.expiryFor(resp, entity)
+	assert.Equal(t, got, validUntil)
+}
+
+func TestMDQClientExpiryForFallsBackToDefaultTTL(t *testing.T) {
+	c := &MDQClient{}
+	resp := &http.Response{Header: http.Header{}}
+
+	before := saml.TimeNow()
+	got := c.expiryFor(resp, nil)
+	after := saml.TimeNow()
+
+	assert.Assert(t, !got.Before(before.Add(mdqDefaultCacheTTL)))
+	assert.Assert(t, !got.After(after.Add(mdqDefaultCacheTTL)))
+}
+
+func TestNextBackoff(t *testing.T) {
+	assert.Equal(t, nextBackoff(0), mdqRefresherMinBackoff)
+	assert.Equal(t, nextBackoff(mdqRefresherMinBackoff), 2*mdqRefresherMinBackoff)
+
+	// Doubling must saturate at mdqRefresherMaxBackoff rather than overflow past it.
+	assert.Equal(t, nextBackoff(mdqRefresherMaxBackoff), mdqRefresherMaxBackoff)
+	assert.Equal(t, nextBackoff(mdqRefresherMaxBackoff/2+time.Minute), mdqRefresherMaxBackoff)
+}
+
+func TestMDQClientResolveConcurrentWithNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"same"`)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	c := &MDQClient{}
+	entityID := "https://idp.example.org/metadata"
+
+	// Seed the cache with an already-expired, but stale-readable, entry
+	// so fetch takes the 304 branch against the concurrent readers below.
+	entity := &saml.EntityDescriptor{EntityID: entityID}
+	c.mu.Lock()
+	c.cache = map[string]*mdqCacheEntry{
+		entityID: {entity: entity, etag: `"same"`, expiresAt: saml.TimeNow().Add(-time.Minute)},
+	}
+	c.mu.Unlock()
+	c.BaseURL = mustParseURL(t, server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.ResolveIDPMetadata(context.Background(), entityID)
+		}()
+	}
+	wg.Wait()
+}
+
+func mustParseURL(t *testing.T, raw string) url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	assert.NilError(t, err)
+	return *u
+}
+
+func TestJitterBounds(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		d := jitter(time.Minute)
+		assert.Assert(t, d >= 0)
+		assert.Assert(t, d < time.Minute)
+	}
+	assert.Equal(t, jitter(0), time.Duration(0))
+}
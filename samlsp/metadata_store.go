@@ -0,0 +1,224 @@
+package samlsp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insaplace/saml"
+	"github.com/insaplace/saml/logger"
+)
+
+// metadataStoreMinRefresh is the minimum interval MetadataStore will wait
+// between refreshes, regardless of how soon the current metadata expires.
+const metadataStoreMinRefresh = 5 * time.Minute
+
+// metadataStoreMaxBackoff bounds how long MetadataStore will back off
+// between retries after consecutive failed refreshes.
+const metadataStoreMaxBackoff = time.Hour
+
+// metadataStoreRefreshFraction is the fraction of an aggregate's
+// remaining validity at which MetadataStore schedules its next refresh.
+const metadataStoreRefreshFraction = 0.75
+
+// MetadataStore wraps FetchEntitiesMetadata with a goroutine-driven
+// background refresh loop, so that ServiceMultipleProvider.IDPMetadata
+// style lookups can consult Current() without blocking on network I/O or
+// going stale the moment they're loaded.
+type MetadataStore struct {
+	// MetadataURL is the full EntitiesDescriptor aggregate endpoint.
+	MetadataURL url.URL
+
+	// HTTPClient is used to fetch metadata. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	current atomic.Pointer[saml.EntitiesDescriptor]
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	backoff      time.Duration
+}
+
+// Current returns the most recently successfully resolved
+// EntitiesDescriptor, or nil if none has been fetched yet, or if the
+// previously fetched aggregate has since expired without a successful
+// refresh (fail-closed).
+func (s *MetadataStore) Current() *saml.EntitiesDescriptor {
+	current := s.current.Load()
+	if current != nil && !current.ValidUntil.IsZero() && saml.TimeNow().After(current.ValidUntil) {
+		return nil
+	}
+	return current
+}
+
+// Start performs an initial blocking fetch and then refreshes current in
+// the background until ctx is canceled.
+func (s *MetadataStore) Start(ctx context.Context) error {
+	wait, err := s.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	go s.run(ctx, wait)
+	return nil
+}
+
+func (s *MetadataStore) run(ctx context.Context, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			next, err := s.refresh(ctx)
+			if err != nil {
+				logger.DefaultLogger.Printf("samlsp: metadata refresh failed, retaining previous metadata until it expires: %v", err)
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// refresh performs a conditional GET against MetadataURL and returns how
+// long to wait before refreshing again.
+func (s *MetadataStore) refresh(ctx context.Context) (time.Duration, error) {
+	httpClient := s.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.MetadataURL.String(), nil)
+	if err != nil {
+		return s.failureWait(), err
+	}
+
+	s.mu.Lock()
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	s.mu.Unlock()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return s.failureWait(), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		s.resetBackoff()
+		return s.nextInterval(s.Current()), nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return s.failureWait(), fmt.Errorf("samlsp: metadata refresh got unexpected status code %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return s.failureWait(), err
+	}
+
+	entities, err := ParseEntitiesMetadata(data)
+	if err != nil {
+		return s.failureWait(), err
+	}
+
+	s.mu.Lock()
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.mu.Unlock()
+
+	s.current.Store(entities)
+	s.resetBackoff()
+	return s.nextInterval(entities), nil
+}
+
+func (s *MetadataStore) resetBackoff() {
+	s.mu.Lock()
+	s.backoff = 0
+	s.mu.Unlock()
+}
+
+// failureWait returns how long to wait before retrying after a transient
+// fetch error, growing the retry interval exponentially (bounded by
+// metadataStoreMaxBackoff) on each consecutive failure so a persistently
+// down metadata endpoint doesn't get hammered indefinitely. It also
+// fail-closes Current() once the previously fetched aggregate's
+// ValidUntil has actually passed -- a transient error alone must not
+// invalidate metadata that is still within its validity window. When it
+// does fail-close, it also clears the stored ETag/Last-Modified: a
+// future conditional GET against a server that hasn't changed its
+// document would otherwise get back a 304 and never restore Current(),
+// since a 304 carries no body to re-parse.
+func (s *MetadataStore) failureWait() time.Duration {
+	current := s.current.Load()
+	if current != nil && !current.ValidUntil.IsZero() && saml.TimeNow().After(current.ValidUntil) {
+		s.current.Store(nil)
+		s.mu.Lock()
+		s.etag = ""
+		s.lastModified = ""
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	if s.backoff == 0 {
+		s.backoff = metadataStoreMinRefresh
+	} else {
+		s.backoff *= 2
+		if s.backoff > metadataStoreMaxBackoff {
+			s.backoff = metadataStoreMaxBackoff
+		}
+	}
+	wait := s.backoff
+	s.mu.Unlock()
+
+	return clampedJitter(wait, metadataStoreMinRefresh)
+}
+
+// nextInterval computes when to refresh next: metadataStoreRefreshFraction
+// of the remaining validity (derived from ValidUntil and/or
+// CacheDuration, whichever is sooner), with a minimum of
+// metadataStoreMinRefresh and full jitter above that floor, to avoid
+// refresh stampedes across replicas without ever refreshing faster than
+// the floor allows.
+func (s *MetadataStore) nextInterval(entities *saml.EntitiesDescriptor) time.Duration {
+	remaining := metadataStoreMinRefresh
+	now := saml.TimeNow()
+
+	if entities != nil {
+		if !entities.ValidUntil.IsZero() {
+			if d := entities.ValidUntil.Sub(now); d > 0 {
+				remaining = d
+			}
+		}
+		if entities.CacheDuration > 0 && entities.CacheDuration < remaining {
+			remaining = entities.CacheDuration
+		}
+	}
+
+	interval := time.Duration(float64(remaining) * metadataStoreRefreshFraction)
+	if interval < metadataStoreMinRefresh {
+		interval = metadataStoreMinRefresh
+	}
+	return clampedJitter(interval, metadataStoreMinRefresh)
+}
+
+// clampedJitter returns floor plus a full-jitter random duration over the
+// portion of d above floor, so the result never drops below floor even
+// after jittering.
+func clampedJitter(d, floor time.Duration) time.Duration {
+	if d <= floor {
+		return floor
+	}
+	return floor + jitter(d-floor)
+}
@@ -0,0 +1,127 @@
+package samlsp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/insaplace/saml"
+	"gotest.tools/assert"
+)
+
+func TestClampedJitter(t *testing.T) {
+	assert.Equal(t, clampedJitter(time.Minute, 5*time.Minute), 5*time.Minute)
+	assert.Equal(t, clampedJitter(5*time.Minute, 5*time.Minute), 5*time.Minute)
+
+	for i := 0; i < 50; i++ {
+		d := clampedJitter(10*time.Minute, 5*time.Minute)
+		assert.Assert(t, d >= 5*time.Minute)
+		assert.Assert(t, d < 10*time.Minute)
+	}
+}
+
+func TestMetadataStoreNextIntervalNeverBelowFloor(t *testing.T) {
+	s := &MetadataStore{}
+
+	// No entities at all: still bounded below by metadataStoreMinRefresh.
+	for i := 0; i < 20; i++ {
+		d := s.nextInterval(nil)
+		assert.Assert(t, d >= metadataStoreMinRefresh)
+	}
+
+	// An aggregate that is already about to expire must not push the
+	// interval below metadataStoreMinRefresh either.
+	entities := &saml.EntitiesDescriptor{ValidUntil: saml.TimeNow().Add(time.Second)}
+	for i := 0; i < 20; i++ {
+		d := s.nextInterval(entities)
+		assert.Assert(t, d >= metadataStoreMinRefresh)
+	}
+}
+
+func TestMetadataStoreNextIntervalUsesCacheDuration(t *testing.T) {
+	s := &MetadataStore{}
+	entities := &saml.EntitiesDescriptor{
+		ValidUntil:    saml.TimeNow().Add(time.Hour),
+		CacheDuration: 20 * time.Minute,
+	}
+
+	d := s.nextInterval(entities)
+	// 75% of the shorter of the two (CacheDuration), but never below the floor.
+	assert.Assert(t, d >= metadataStoreMinRefresh)
+	assert.Assert(t, d <= 20*time.Minute)
+}
+
+func TestMetadataStoreFailureWaitGrowsAndSaturates(t *testing.T) {
+	s := &MetadataStore{}
+
+	first := s.failureWait()
+	assert.Assert(t, first >= metadataStoreMinRefresh)
+	s.mu.Lock()
+	firstBackoff := s.backoff
+	s.mu.Unlock()
+	assert.Equal(t, firstBackoff, metadataStoreMinRefresh)
+
+	s.failureWait()
+	s.mu.Lock()
+	secondBackoff := s.backoff
+	s.mu.Unlock()
+	assert.Equal(t, secondBackoff, 2*metadataStoreMinRefresh)
+
+	s.mu.Lock()
+	s.backoff = metadataStoreMaxBackoff
+	s.mu.Unlock()
+
+	capped := s.failureWait()
+	assert.Assert(t, capped <= metadataStoreMaxBackoff)
+	s.mu.Lock()
+	cappedBackoff := s.backoff
+	s.mu.Unlock()
+	assert.Equal(t, cappedBackoff, metadataStoreMaxBackoff)
+}
+
+func TestMetadataStoreFailureWaitClearsConditionalHeadersOnFailClose(t *testing.T) {
+	s := &MetadataStore{}
+	s.current.Store(&saml.EntitiesDescriptor{ValidUntil: saml.TimeNow().Add(-time.Minute)})
+	s.mu.Lock()
+	s.etag = `"stale-etag"`
+	s.lastModified = "stale-last-modified"
+	s.mu.Unlock()
+
+	s.failureWait()
+
+	assert.Assert(t, s.Current() == nil)
+	s.mu.Lock()
+	etag, lastModified := s.etag, s.lastModified
+	s.mu.Unlock()
+	assert.Equal(t, etag, "")
+	assert.Equal(t, lastModified, "")
+}
+
+func TestMetadataStoreFailureWaitKeepsConditionalHeadersBeforeExpiry(t *testing.T) {
+	s := &MetadataStore{}
+	s.current.Store(&saml.EntitiesDescriptor{ValidUntil: saml.TimeNow().Add(time.Hour)})
+	s.mu.Lock()
+	s.etag = `"fresh-etag"`
+	s.mu.Unlock()
+
+	s.failureWait()
+
+	assert.Assert(t, s.Current() != nil)
+	s.mu.Lock()
+	etag := s.etag
+	s.mu.Unlock()
+	assert.Equal(t, etag, `"fresh-etag"`)
+}
+
+func TestMetadataStoreResetBackoff(t *testing.T) {
+	s := &MetadataStore{}
+	s.mu.Lock()
+	s.backoff = metadataStoreMaxBackoff
+	s.mu.Unlock()
+
+	s.resetBackoff()
+
+	s.mu.Lock()
+	backoff := s.backoff
+	s.mu.Unlock()
+	assert.Equal(t, backoff, time.Duration(0))
+}
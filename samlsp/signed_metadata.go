@@ -0,0 +1,263 @@
+package samlsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/insaplace/saml"
+)
+
+// ErrUntrustedSigner is returned when a metadata document's signer is not
+// covered by the configured trust anchor. With Fingerprints alone, it is
+// returned when the document's own KeyInfo certificate matches none of the
+// pinned fingerprints; that check happens before the signature itself is
+// validated. With TrustRoots, it is returned when the signature validates
+// only against TrustRoots certificates that match none of the pinned
+// Fingerprints; if validation fails against a TrustRoots certificate and
+// none is accepted, that validation error is returned instead.
+var ErrUntrustedSigner = errors.New("samlsp: metadata signer is not trusted")
+
+// ParseMetadataOptions configures signature verification for
+// ParseSignedMetadata, ParseSignedEntitiesMetadata and
+// FetchSignedEntitiesMetadata. At least one of TrustRoots or Fingerprints
+// must be set.
+type ParseMetadataOptions struct {
+	// TrustRoots are the federation operator certificates that are
+	// allowed to sign the metadata document. If Fingerprints is also
+	// set, the signer must additionally match one of those fingerprints.
+	TrustRoots []*x509.Certificate
+
+	// Fingerprints, if set and TrustRoots is empty, pins trust directly
+	// to the document's own self-asserted <ds:KeyInfo> certificate: the
+	// signature is accepted if it validates against that certificate and
+	// the certificate's SHA-256 fingerprint is one of these. This is a
+	// trust-on-first-use mode for callers that have obtained a
+	// federation operator's certificate fingerprint out of band (e.g.
+	// published alongside the metadata URL) but don't have the
+	// certificate itself to use as a TrustRoots entry.
+	//
+	// If TrustRoots is also set, Fingerprints instead further restricts
+	// which TrustRoots certificate may sign the document, as above.
+	Fingerprints [][32]byte
+}
+
+// SignedEntityDescriptor is an EntityDescriptor whose enveloped signature
+// has been verified against a trust anchor, together with the signer
+// identity that vouched for it.
+type SignedEntityDescriptor struct {
+	*saml.EntityDescriptor
+	Signer *x509.Certificate
+}
+
+// SignedEntitiesDescriptor is an EntitiesDescriptor whose enveloped
+// signature has been verified against a trust anchor, together with the
+// signer identity that vouched for it.
+type SignedEntitiesDescriptor struct {
+	*saml.EntitiesDescriptor
+	Signer *x509.Certificate
+}
+
+// ParseSignedMetadata parses a single signed EntityDescriptor, verifying
+// its enveloped <ds:Signature> against opts before returning it.
+func ParseSignedMetadata(data []byte, opts ParseMetadataOptions) (*SignedEntityDescriptor, error) {
+	signer, err := verifyEnvelopedSignature(data, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entity, err := ParseMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidUntil(entity.ValidUntil); err != nil {
+		return nil, err
+	}
+
+	return &SignedEntityDescriptor{EntityDescriptor: entity, Signer: signer}, nil
+}
+
+// ParseSignedEntitiesMetadata parses a signed EntitiesDescriptor
+// aggregate (the form published by eduGAIN, InCommon and similar
+// federations), verifying its enveloped <ds:Signature> against opts
+// before returning it.
+func ParseSignedEntitiesMetadata(data []byte, opts ParseMetadataOptions) (*SignedEntitiesDescriptor, error) {
+	signer, err := verifyEnvelopedSignature(data, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := ParseEntitiesMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidUntil(entities.ValidUntil); err != nil {
+		return nil, err
+	}
+
+	return &SignedEntitiesDescriptor{EntitiesDescriptor: entities, Signer: signer}, nil
+}
+
+// FetchSignedEntitiesMetadata fetches and verifies a signed
+// EntitiesDescriptor aggregate from metadataURL.
+func FetchSignedEntitiesMetadata(ctx context.Context, httpClient *http.Client, metadataURL url.URL, opts ParseMetadataOptions) (*SignedEntitiesDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("failed to fetch metadata: unexpected status code %d", resp.StatusCode)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+
+	return ParseSignedEntitiesMetadata(buf.Bytes(), opts)
+}
+
+// verifyEnvelopedSignature validates the enveloped <ds:Signature> on the
+// root element of data and returns the certificate that produced it. It
+// rejects signatures whose certificate isn't covered by opts.TrustRoots
+// (or, when TrustRoots is empty, pinned via opts.Fingerprints) --
+// goxmldsig only proves the signature is internally consistent with
+// whatever KeyInfo the document itself carries, which is
+// attacker-controlled, so the signer identity must additionally be
+// checked against a trust anchor we configured out of band.
+func verifyEnvelopedSignature(data []byte, opts ParseMetadataOptions) (*x509.Certificate, error) {
+	if len(opts.TrustRoots) == 0 && len(opts.Fingerprints) == 0 {
+		return nil, errors.New("samlsp: ParseMetadataOptions must set TrustRoots or Fingerprints")
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+
+	if len(opts.TrustRoots) == 0 {
+		return verifyEnvelopedSignatureByFingerprint(doc, opts.Fingerprints)
+	}
+
+	// Validate against each candidate trust-anchor certificate in turn,
+	// rather than trusting whatever certificate the document's own
+	// KeyInfo happens to present: KeyInfo is attacker-controlled, so the
+	// signer must be one we configured out of band.
+	var lastErr error
+	for _, root := range opts.TrustRoots {
+		store := dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{root}}
+		ctx := dsig.NewDefaultValidationContext(&store)
+
+		if _, err := ctx.Validate(doc.Root()); err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(opts.Fingerprints) > 0 && !fingerprintPinned(root, opts.Fingerprints) {
+			continue
+		}
+
+		return root, nil
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("samlsp: signature validation failed: %w", lastErr)
+	}
+	return nil, ErrUntrustedSigner
+}
+
+// verifyEnvelopedSignatureByFingerprint implements the Fingerprints-only
+// trust-on-first-use mode: the document's own <ds:KeyInfo> certificate is
+// extracted and checked against fingerprints *before* it's ever used to
+// validate anything, so an attacker-supplied KeyInfo is rejected on the
+// fingerprint check rather than being implicitly trusted to validate
+// itself.
+func verifyEnvelopedSignatureByFingerprint(doc *etree.Document, fingerprints [][32]byte) (*x509.Certificate, error) {
+	cert, err := extractKeyInfoCertificate(doc)
+	if err != nil {
+		return nil, err
+	}
+	if !fingerprintPinned(cert, fingerprints) {
+		return nil, ErrUntrustedSigner
+	}
+
+	store := dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}}
+	ctx := dsig.NewDefaultValidationContext(&store)
+	if _, err := ctx.Validate(doc.Root()); err != nil {
+		return nil, fmt.Errorf("samlsp: signature validation failed: %w", err)
+	}
+
+	return cert, nil
+}
+
+// extractKeyInfoCertificate finds the enveloped <ds:Signature> on doc's
+// root element and parses the <ds:X509Certificate> from its own KeyInfo.
+// It deliberately scopes the search to that one Signature element rather
+// than searching the whole document: a metadata aggregate routinely
+// embeds unrelated <KeyDescriptor><ds:KeyInfo><ds:X509Data>
+// <ds:X509Certificate> blocks per EntityDescriptor using the identical
+// tag, so a document-wide search could silently pick a decoy certificate
+// instead of the one that actually produced the signature being
+// verified.
+func extractKeyInfoCertificate(doc *etree.Document) (*x509.Certificate, error) {
+	sig := doc.Root().FindElement("./Signature")
+	if sig == nil {
+		return nil, errors.New("samlsp: document has no enveloped Signature element")
+	}
+
+	el := sig.FindElement(".//X509Certificate")
+	if el == nil {
+		return nil, errors.New("samlsp: signature has no KeyInfo X509Certificate to pin a fingerprint against")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(el.Text()))
+	if err != nil {
+		return nil, fmt.Errorf("samlsp: invalid KeyInfo X509Certificate encoding: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("samlsp: invalid KeyInfo X509Certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// fingerprintPinned reports whether cert's SHA-256 fingerprint is one of fingerprints.
+func fingerprintPinned(cert *x509.Certificate, fingerprints [][32]byte) bool {
+	sum := sha256.Sum256(cert.Raw)
+	for _, fp := range fingerprints {
+		if fp == sum {
+			return true
+		}
+	}
+	return false
+}
+
+// checkValidUntil rejects a metadata document whose validUntil has
+// already passed. A valid signature says nothing about freshness: a
+// federation operator's withdrawn or superseded EntitiesDescriptor
+// remains perfectly well-signed.
+func checkValidUntil(validUntil time.Time) error {
+	if !validUntil.IsZero() && validUntil.Before(saml.TimeNow()) {
+		return fmt.Errorf("samlsp: metadata validUntil %s has passed", validUntil)
+	}
+	return nil
+}
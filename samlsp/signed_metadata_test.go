@@ -0,0 +1,144 @@
+package samlsp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"gotest.tools/assert"
+)
+
+func generateTestCertificate(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "samlsp test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NilError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return cert
+}
+
+// keyInfoDoc builds a document whose enveloped <ds:Signature> carries
+// cert's KeyInfo, optionally preceded by an unrelated KeyDescriptor
+// carrying decoyCert's certificate under the identical tag/namespace --
+// mirroring how a real metadata aggregate embeds one
+// <KeyDescriptor><ds:KeyInfo> per EntityDescriptor alongside the
+// aggregate's own enveloped signature.
+func keyInfoDoc(t *testing.T, cert, decoyCert *x509.Certificate) *etree.Document {
+	t.Helper()
+
+	var decoy string
+	if decoyCert != nil {
+		decoy = fmt.Sprintf(`<KeyDescriptor><ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></KeyDescriptor>`,
+			base64.StdEncoding.EncodeToString(decoyCert.Raw))
+	}
+
+	xml := fmt.Sprintf(`<EntitiesDescriptor>
+		%s
+		<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+			<ds:KeyInfo>
+				<ds:X509Data>
+					<ds:X509Certificate>%s</ds:X509Certificate>
+				</ds:X509Data>
+			</ds:KeyInfo>
+		</ds:Signature>
+	</EntitiesDescriptor>`, decoy, base64.StdEncoding.EncodeToString(cert.Raw))
+
+	doc := etree.NewDocument()
+	assert.NilError(t, doc.ReadFromString(xml))
+	return doc
+}
+
+func TestExtractKeyInfoCertificate(t *testing.T) {
+	cert := generateTestCertificate(t)
+	doc := keyInfoDoc(t, cert, nil)
+
+	got, err := extractKeyInfoCertificate(doc)
+	assert.NilError(t, err)
+	assert.Assert(t, got.Equal(cert))
+}
+
+func TestExtractKeyInfoCertificateIgnoresUnrelatedKeyInfo(t *testing.T) {
+	cert := generateTestCertificate(t)
+	decoy := generateTestCertificate(t)
+	doc := keyInfoDoc(t, cert, decoy)
+
+	got, err := extractKeyInfoCertificate(doc)
+	assert.NilError(t, err)
+	assert.Assert(t, got.Equal(cert))
+	assert.Assert(t, !got.Equal(decoy))
+}
+
+func TestExtractKeyInfoCertificateNoSignature(t *testing.T) {
+	doc := etree.NewDocument()
+	assert.NilError(t, doc.ReadFromString(`<EntitiesDescriptor></EntitiesDescriptor>`))
+
+	_, err := extractKeyInfoCertificate(doc)
+	assert.ErrorContains(t, err, "Signature")
+}
+
+func TestExtractKeyInfoCertificateMissing(t *testing.T) {
+	doc := etree.NewDocument()
+	assert.NilError(t, doc.ReadFromString(`<EntitiesDescriptor>
+		<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"></ds:Signature>
+	</EntitiesDescriptor>`))
+
+	_, err := extractKeyInfoCertificate(doc)
+	assert.ErrorContains(t, err, "KeyInfo")
+}
+
+func TestExtractKeyInfoCertificateInvalidEncoding(t *testing.T) {
+	doc := etree.NewDocument()
+	assert.NilError(t, doc.ReadFromString(`<EntitiesDescriptor>
+		<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+			<ds:X509Certificate>not-base64!!</ds:X509Certificate>
+		</ds:Signature>
+	</EntitiesDescriptor>`))
+
+	_, err := extractKeyInfoCertificate(doc)
+	assert.ErrorContains(t, err, "encoding")
+}
+
+func TestFingerprintPinned(t *testing.T) {
+	cert := generateTestCertificate(t)
+	other := generateTestCertificate(t)
+
+	sum := sha256.Sum256(cert.Raw)
+	assert.Assert(t, fingerprintPinned(cert, [][32]byte{sum}))
+	assert.Assert(t, !fingerprintPinned(other, [][32]byte{sum}))
+	assert.Assert(t, !fingerprintPinned(cert, nil))
+}
+
+func TestVerifyEnvelopedSignatureRequiresTrustRootsOrFingerprints(t *testing.T) {
+	_, err := verifyEnvelopedSignature([]byte(`<EntitiesDescriptor></EntitiesDescriptor>`), ParseMetadataOptions{})
+	assert.ErrorContains(t, err, "TrustRoots or Fingerprints")
+}
+
+func TestVerifyEnvelopedSignatureByFingerprintRejectsUnpinnedCert(t *testing.T) {
+	cert := generateTestCertificate(t)
+	doc := keyInfoDoc(t, cert, nil)
+
+	other := generateTestCertificate(t)
+	sum := sha256.Sum256(other.Raw)
+
+	_, err := verifyEnvelopedSignatureByFingerprint(doc, [][32]byte{sum})
+	assert.Equal(t, err, ErrUntrustedSigner)
+}
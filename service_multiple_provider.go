@@ -4,8 +4,8 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/base64"
-	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"time"
@@ -74,6 +74,29 @@ type ServiceMultipleProvider struct {
 	// LogoutBindings specify the bindings available for SLO endpoint. If empty,
 	// HTTP-POST binding is used.
 	LogoutBindings []string
+
+	// MetadataResolver, if set, is consulted by GetIDPMetadata to resolve
+	// IDP metadata on demand (e.g. via MDQ) instead of requiring the full
+	// IDPMetadata aggregate to be loaded up front.
+	MetadataResolver MetadataResolver
+
+	// DiscoveryTemplate, if set, is used by ServeDiscoveryRequest to
+	// render the IDP chooser presented to the user. If nil, a minimal
+	// built-in template is used.
+	DiscoveryTemplate *template.Template
+
+	// AllowedDiscoveryReturnURLs registers, per requesting SP entityID,
+	// the return URLs ServeDiscoveryRequest will redirect back to. This is
+	// a stand-in for validating against the SP's own
+	// <idpdisc:DiscoveryResponse> metadata extension: this codebase's
+	// metadata parser does not yet capture raw <Extensions> content from
+	// role descriptors, so that can't be derived automatically yet.
+	AllowedDiscoveryReturnURLs map[string][]string
+
+	// ArtifactResolutionURL, if set, is advertised in the SP metadata as
+	// an ArtifactResolutionService, for a future IDP-mode where artifacts
+	// issued by this SP can themselves be resolved by peers.
+	ArtifactResolutionURL *url.URL
 }
 
 func (smp *ServiceMultipleProvider) GetServiceProvider(entityID string) (ServiceProvider, error) {
@@ -86,35 +109,6 @@ func (smp *ServiceMultipleProvider) GetServiceProvider(entityID string) (Service
 	return sp, nil
 }
 
-func (smp *ServiceMultipleProvider) MakeWayfRedirectionRequest(relayState, returnUrl string) (*url.URL, error) {
-	u, err := url.Parse(returnUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	query := u.Query()
-	query.Add("rs", relayState)
-	u.RawQuery = query.Encode()
-
-	wayfUrl := smp.IDPMetadata.Name
-
-	if wayfUrl == nil {
-		return nil, errors.New("identity name is not set")
-	}
-
-	wu, err := url.Parse(*wayfUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	query = wu.Query()
-	query.Add("return", u.String())
-	query.Add("entityID", smp.EntityID)
-	wu.RawQuery = query.Encode()
-
-	return wu, nil
-}
-
 func (smp *ServiceMultipleProvider) Metadata() *EntityDescriptor {
 	validDuration := DefaultValidDuration
 	if smp.MetadataValidDuration > 0 {
@@ -184,8 +178,9 @@ func (smp *ServiceMultipleProvider) Metadata() *EntityDescriptor {
 						KeyDescriptors:             keyDescriptors,
 						ValidUntil:                 &validUntil,
 					},
-					SingleLogoutServices: sloEndpoints,
-					NameIDFormats:        []NameIDFormat{smp.AuthnNameIDFormat},
+					SingleLogoutServices:       sloEndpoints,
+					NameIDFormats:              []NameIDFormat{smp.AuthnNameIDFormat},
+					ArtifactResolutionServices: artifactResolutionServices(smp.ArtifactResolutionURL),
 				},
 				AuthnRequestsSigned:  &authnRequestsSigned,
 				WantAssertionsSigned: &wantAssertionsSigned,